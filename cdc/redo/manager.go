@@ -0,0 +1,570 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redo
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tiflow/cdc/contextutil"
+	"github.com/pingcap/tiflow/cdc/model"
+	"github.com/pingcap/tiflow/cdc/processor/tablepb"
+	"github.com/pingcap/tiflow/cdc/redo/writer"
+	"github.com/pingcap/tiflow/cdc/redo/writer/factory"
+	"github.com/pingcap/tiflow/pkg/chann"
+	"github.com/pingcap/tiflow/pkg/config"
+	"github.com/pingcap/tiflow/pkg/redo"
+	"github.com/pingcap/tiflow/pkg/spanz"
+	"github.com/tikv/client-go/v2/oracle"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+)
+
+// flushMode describes how bgUpdateLog flushes the per-span buffers against
+// the global minimum resolved ts.
+type flushMode int
+
+const (
+	// consistentMode is the default mode: the manager only advances
+	// GetMinResolvedTs once every span has caught up, matching the
+	// durability guarantees redo consistency depends on.
+	consistentMode flushMode = iota
+	// bestEffortMode is selected once the slowest span has fallen
+	// BestEffortWindow behind wall-clock time. In this mode a flush does not
+	// update the value GetMinResolvedTs reports: it keeps the value set by
+	// the last consistent-mode flush, AddTable or RemoveTable, while each
+	// span's own entry in rtsMap keeps advancing through onResolvedTsMsg.
+	// The underlying writer.FlushLog call itself is still a single global
+	// flush driven by bgUpdateLog's shared ticker: this mode does not change
+	// how often or independently each span's buffer is physically flushed
+	// to storage.
+	bestEffortMode
+)
+
+// LogManager defines the interfaces for redo log manager
+type LogManager interface {
+	// Enabled returns whether the log manager is enabled
+	Enabled() bool
+
+	// AddTable adds a new table in redo log manager
+	AddTable(span tablepb.Span, startTs uint64)
+	// RemoveTable removes a table from redo log manager
+	RemoveTable(span tablepb.Span)
+
+	// EmitRowChangedEvents sends row changed events to a log buffer, which
+	// will be consumed by a background goroutine, which converts row
+	// changed events to redo logs and flushes them to storage.
+	EmitRowChangedEvents(
+		ctx context.Context, span tablepb.Span,
+		tableInfo *model.TableInfo, rows ...*model.RowChangedEvent,
+	) error
+
+	// EmitDDLEvent sends DDL event to redo log writer
+	EmitDDLEvent(ctx context.Context, ddl *model.DDLEvent) error
+
+	// UpdateResolvedTs updates a table's resolved ts without row changed events
+	UpdateResolvedTs(ctx context.Context, span tablepb.Span, resolvedTs uint64) error
+
+	// GetMinResolvedTs returns the minimum resolved ts of all tables in the
+	// log manager, which is safe to be used as the redo log's checkpoint ts
+	// while the manager is in consistent mode.
+	GetMinResolvedTs() uint64
+
+	// Cleanup removes all redo logs of the changefeed
+	Cleanup(ctx context.Context) error
+
+	// PrepareSnapshot freezes the manager's current per-span frontier and
+	// returns a handle describing it, for coordinating with an external,
+	// BR-style backup of the upstream.
+	PrepareSnapshot(ctx context.Context, id string) (SnapshotHandle, error)
+	// WaitPrepared blocks until the frontier captured by handle is durable.
+	WaitPrepared(ctx context.Context, handle SnapshotHandle) error
+	// CommitSnapshot unfreezes the manager and installs handle's frontier
+	// as the manager's resumable checkpoint.
+	CommitSnapshot(handle SnapshotHandle) error
+	// AbortSnapshot unfreezes the manager without publishing handle.
+	AbortSnapshot(handle SnapshotHandle) error
+}
+
+// cacheEvents buffers row changed events of a given span before they are
+// written to the underlying redo log writer.
+type cacheEvents struct {
+	span       tablepb.Span
+	rows       []*model.RowChangedEvent
+	resolvedTs uint64
+
+	// eventType distinguishes row events from resolved-ts-only notifications.
+	eventType model.MessageType
+}
+
+// ManagerOptions defines options for redo log manager.
+type ManagerOptions struct {
+	// EnableBgRunner indicates whether to enable background goroutine
+	EnableBgRunner bool
+	// EnableGCRunner indicates whether to enable GC goroutine
+	EnableGCRunner bool
+	ErrCh          chan error
+}
+
+// ManagerImpl manages redo log writing and global resolved ts for a changefeed.
+type ManagerImpl struct {
+	changeFeedID model.ChangeFeedID
+	cfg          *config.ConsistentConfig
+	writer       writer.RedoLogWriter
+
+	logBuffer *chann.AutoDrainChann[cacheEvents]
+
+	rtsMapMu sync.RWMutex
+	rtsMap   *spanz.HashMap[model.Ts]
+
+	// minResolvedTs is read through GetMinResolvedTs and is kept consistent
+	// with rtsMap under rtsMapMu.
+	minResolvedTs uint64
+
+	// mode reflects the most recently selected flush mode. It is updated
+	// once per bgUpdateLog tick and read through IsBestEffortMode.
+	mode int32 // flushMode, accessed atomically
+
+	// clock is used to decide whether the manager should switch into
+	// best-effort mode; it is overridable in tests.
+	clock func() time.Time
+
+	// snapshotMu guards the PrepareSnapshot/CommitSnapshot/AbortSnapshot
+	// state below, so at most one snapshot can be in progress at a time.
+	snapshotMu     sync.Mutex
+	frozen         atomic.Bool
+	freezeCeiling  *spanz.HashMap[model.Ts]
+	frozenCh       chan struct{}
+	lastCheckpoint *snapshotManifest
+
+	// minTimestamp/maxTimestamp bound which CommitTs values the manager will
+	// accept, for replaying a bounded window of existing redo files into a
+	// downstream sink. Zero means unbounded on that side.
+	minTimestamp atomic.Uint64
+	maxTimestamp atomic.Uint64
+
+	// bgRunnerEnabled records whether bgUpdateLog owns logBuffer and the
+	// writer. When true, drainAndFlush must route its work through
+	// drainReq instead of reading logBuffer directly, so the two goroutines
+	// never race to consume the channel or call the writer concurrently.
+	bgRunnerEnabled bool
+	drainReq        chan chan error
+
+	closed int32
+}
+
+// NewManager creates a new ManagerImpl.
+func NewManager(
+	ctx context.Context, cfg *config.ConsistentConfig, opts *ManagerOptions,
+) (*ManagerImpl, error) {
+	if !redo.IsConsistentEnabled(cfg.Level) {
+		return &ManagerImpl{cfg: cfg}, nil
+	}
+
+	changeFeedID := contextutil.ChangefeedIDFromCtx(ctx)
+	w, err := factory.NewRedoLogWriter(ctx, cfg)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	m := &ManagerImpl{
+		changeFeedID:    changeFeedID,
+		cfg:             cfg,
+		writer:          w,
+		logBuffer:       chann.NewAutoDrainChann[cacheEvents](),
+		rtsMap:          spanz.NewHashMap[model.Ts](),
+		clock:           time.Now,
+		bgRunnerEnabled: opts.EnableBgRunner,
+		drainReq:        make(chan chan error),
+	}
+	m.minTimestamp.Store(uint64(cfg.MinTimestamp))
+	m.maxTimestamp.Store(uint64(cfg.MaxTimestamp))
+
+	if opts.EnableBgRunner {
+		g, egCtx := errgroup.WithContext(ctx)
+		g.Go(func() error {
+			return m.bgUpdateLog(egCtx, cfg.FlushIntervalInMs, opts.ErrCh)
+		})
+		go func() {
+			if err := g.Wait(); err != nil && errors.Cause(err) != context.Canceled {
+				select {
+				case opts.ErrCh <- err:
+				default:
+					log.Error("redo manager background runner exits with error",
+						zap.String("namespace", changeFeedID.Namespace),
+						zap.String("changefeed", changeFeedID.ID), zap.Error(err))
+				}
+			}
+		}()
+	}
+	return m, nil
+}
+
+// NewMockManager creates a ManagerImpl for testing purposes, backed by a
+// blackhole writer so no data is actually written to any external storage.
+func NewMockManager(ctx context.Context) (*ManagerImpl, error) {
+	cfg := &config.ConsistentConfig{
+		Level:             string(redo.ConsistentLevelEventual),
+		Storage:           "blackhole://",
+		FlushIntervalInMs: config.DefaultFlushIntervalInMs,
+	}
+	errCh := make(chan error, 1)
+	opts := newMockManagerOptions(errCh)
+	return NewManager(ctx, cfg, opts)
+}
+
+func newMockManagerOptions(errCh chan error) *ManagerOptions {
+	return &ManagerOptions{
+		EnableBgRunner: true,
+		EnableGCRunner: false,
+		ErrCh:          errCh,
+	}
+}
+
+// Enabled returns whether the log manager is writing redo logs.
+func (m *ManagerImpl) Enabled() bool {
+	return redo.IsConsistentEnabled(m.cfg.Level)
+}
+
+// AddTable starts tracking the resolved ts of a table.
+func (m *ManagerImpl) AddTable(span tablepb.Span, startTs uint64) {
+	m.rtsMapMu.Lock()
+	defer m.rtsMapMu.Unlock()
+	if _, ok := m.rtsMap.Get(span); ok {
+		log.Warn("redo manager adds a table already tracked",
+			zap.Stringer("span", &span))
+	}
+	m.rtsMap.ReplaceOrInsert(span, model.Ts(startTs))
+	m.adjustMinResolvedTsLocked()
+}
+
+// RemoveTable stops tracking the resolved ts of a table.
+func (m *ManagerImpl) RemoveTable(span tablepb.Span) {
+	m.rtsMapMu.Lock()
+	defer m.rtsMapMu.Unlock()
+	m.rtsMap.Delete(span)
+	m.adjustMinResolvedTsLocked()
+}
+
+// adjustMinResolvedTsLocked recomputes minResolvedTs from rtsMap.
+// rtsMapMu must be held by the caller.
+func (m *ManagerImpl) adjustMinResolvedTsLocked() {
+	minTs := uint64(math.MaxInt64)
+	m.rtsMap.Range(func(_ tablepb.Span, ts model.Ts) bool {
+		if uint64(ts) < minTs {
+			minTs = uint64(ts)
+		}
+		return true
+	})
+	atomic.StoreUint64(&m.minResolvedTs, minTs)
+}
+
+// onResolvedTsMsg advances a single span's resolved ts, without requiring
+// every other span to also have advanced. While a snapshot is in progress,
+// it clamps resolvedTs to the frozen ceiling, so a resolved-ts message
+// already buffered before the freeze can't advance a span past the
+// frontier the snapshot captured.
+func (m *ManagerImpl) onResolvedTsMsg(span tablepb.Span, resolvedTs model.Ts) {
+	m.snapshotMu.Lock()
+	if m.frozen.Load() {
+		if ceiling, ok := m.freezeCeiling.Get(span); ok && resolvedTs > ceiling {
+			resolvedTs = ceiling
+		}
+	}
+	m.snapshotMu.Unlock()
+
+	m.rtsMapMu.Lock()
+	defer m.rtsMapMu.Unlock()
+	if ts, ok := m.rtsMap.Get(span); ok && resolvedTs > ts {
+		m.rtsMap.ReplaceOrInsert(span, resolvedTs)
+	}
+}
+
+// GetMinResolvedTs returns the minimum resolved ts across all tables. It
+// never exceeds the configured MaxTimestamp, so a bounded replay never
+// reports a watermark past the upper bound it was pinned to.
+func (m *ManagerImpl) GetMinResolvedTs() uint64 {
+	ts := atomic.LoadUint64(&m.minResolvedTs)
+	if maxTs := m.maxTimestamp.Load(); maxTs != 0 && ts > maxTs {
+		return maxTs
+	}
+	return ts
+}
+
+// ErrRedoTsExceedsMax is returned by EmitRowChangedEvents/EmitDDLEvent when
+// an event's CommitTs is newer than the manager's configured MaxTimestamp.
+// Callers should treat it as back-pressure: wait and retry once the upper
+// bound is raised or the event is no longer needed.
+var ErrRedoTsExceedsMax = errors.New("redo: commit ts exceeds configured MaxTimestamp")
+
+// SetTimestampRange sets the inclusive [min, max] CommitTs window the
+// manager will accept events for. A zero min/max leaves that side unbounded.
+func (m *ManagerImpl) SetTimestampRange(min, max model.Ts) error {
+	if max != 0 && min > max {
+		return errors.New("redo: MinTimestamp must not be greater than MaxTimestamp")
+	}
+	m.minTimestamp.Store(uint64(min))
+	m.maxTimestamp.Store(uint64(max))
+	return nil
+}
+
+// IsBestEffortMode reports whether the most recent flush ran in best-effort
+// mode, i.e. without updating the value GetMinResolvedTs reports.
+func (m *ManagerImpl) IsBestEffortMode() bool {
+	return flushMode(atomic.LoadInt32(&m.mode)) == bestEffortMode
+}
+
+// EmitRowChangedEvents buffers row changed events for async writing.
+func (m *ManagerImpl) EmitRowChangedEvents(
+	ctx context.Context, span tablepb.Span,
+	tableInfo *model.TableInfo, rows ...*model.RowChangedEvent,
+) error {
+	if !m.Enabled() || m.isClosed() {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	default:
+	}
+	var maxCommitTs model.Ts
+	maxTs := model.Ts(m.maxTimestamp.Load())
+	minTs := model.Ts(m.minTimestamp.Load())
+	kept := rows[:0:0]
+	for _, row := range rows {
+		ts := model.Ts(row.CommitTs)
+		if ts > maxCommitTs {
+			maxCommitTs = ts
+		}
+		if maxTs != 0 && ts > maxTs {
+			// An out-of-range event aborts the whole call: the caller should
+			// back off rather than have some rows silently skipped.
+			return ErrRedoTsExceedsMax
+		}
+		if minTs != 0 && ts < minTs {
+			// Dropped without being written. maxCommitTs above still counts
+			// it for the freeze check below; the span's resolved ts is
+			// advanced by UpdateResolvedTs as usual.
+			continue
+		}
+		kept = append(kept, row)
+	}
+	if err := m.waitIfFrozen(ctx, span, maxCommitTs); err != nil {
+		return errors.Trace(err)
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	m.logBuffer.In() <- cacheEvents{span: span, rows: kept, eventType: model.MessageTypeRow}
+	return nil
+}
+
+// EmitDDLEvent writes a DDL event directly through the writer.
+func (m *ManagerImpl) EmitDDLEvent(ctx context.Context, ddl *model.DDLEvent) error {
+	if !m.Enabled() || m.isClosed() {
+		return nil
+	}
+	ts := model.Ts(ddl.CommitTs)
+	if maxTs := model.Ts(m.maxTimestamp.Load()); maxTs != 0 && ts > maxTs {
+		return ErrRedoTsExceedsMax
+	}
+	if minTs := model.Ts(m.minTimestamp.Load()); minTs != 0 && ts < minTs {
+		return nil
+	}
+	return m.writer.WriteLog(ctx, tablepb.DDLSpan, nil)
+}
+
+// UpdateResolvedTs advances a span's resolved ts when there are no new rows.
+func (m *ManagerImpl) UpdateResolvedTs(ctx context.Context, span tablepb.Span, resolvedTs uint64) error {
+	if !m.Enabled() {
+		return nil
+	}
+	if m.isClosed() {
+		return errors.New("redo manager is closed")
+	}
+	select {
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	default:
+	}
+	if maxTs := m.maxTimestamp.Load(); maxTs != 0 && resolvedTs > maxTs {
+		resolvedTs = maxTs
+	}
+	if err := m.waitIfFrozen(ctx, span, model.Ts(resolvedTs)); err != nil {
+		return errors.Trace(err)
+	}
+	m.logBuffer.In() <- cacheEvents{
+		span: span, resolvedTs: resolvedTs, eventType: model.MessageTypeResolved,
+	}
+	return nil
+}
+
+// Cleanup removes all redo logs of the changefeed.
+func (m *ManagerImpl) Cleanup(ctx context.Context) error {
+	atomic.StoreInt32(&m.closed, 1)
+	if m.writer == nil {
+		return nil
+	}
+	return m.writer.DeleteAllLogs(ctx)
+}
+
+func (m *ManagerImpl) isClosed() bool {
+	return atomic.LoadInt32(&m.closed) != 0
+}
+
+// prepareForFlush takes a stable snapshot of rtsMap to flush, returning the
+// snapshot together with its minimum resolved ts.
+func (m *ManagerImpl) prepareForFlush() (*spanz.HashMap[model.Ts], uint64) {
+	m.rtsMapMu.RLock()
+	defer m.rtsMapMu.RUnlock()
+
+	tables := spanz.NewHashMap[model.Ts]()
+	minTs := uint64(math.MaxInt64)
+	m.rtsMap.Range(func(span tablepb.Span, ts model.Ts) bool {
+		tables.ReplaceOrInsert(span, ts)
+		if uint64(ts) < minTs {
+			minTs = uint64(ts)
+		}
+		return true
+	})
+	if tables.Len() == 0 {
+		minTs = 0
+	}
+	return tables, minTs
+}
+
+// postFlush installs the flushed snapshot's minimum resolved ts as the new
+// global minimum, in consistent mode. It is not called in best-effort mode,
+// where only the per-span entries in rtsMap advance, via onResolvedTsMsg.
+func (m *ManagerImpl) postFlush(tables *spanz.HashMap[model.Ts], minTs uint64) {
+	m.rtsMapMu.Lock()
+	defer m.rtsMapMu.Unlock()
+	if tables.Len() == 0 {
+		atomic.StoreUint64(&m.minResolvedTs, uint64(math.MaxInt64))
+		return
+	}
+	atomic.StoreUint64(&m.minResolvedTs, minTs)
+}
+
+// flushLog drains the buffered cache events and flushes them through the
+// writer. It selects consistent or best-effort mode for this tick from the
+// minimum resolved ts taken by a first prepareForFlush call: in best-effort
+// mode the post-flush prepareForFlush and postFlush are skipped, so the
+// value GetMinResolvedTs reports is left unchanged, while each span's entry
+// in rtsMap (advanced by onResolvedTsMsg as events arrive) stands on its own.
+//
+// Note this is a single m.writer.FlushLog call shared by every span on
+// bgUpdateLog's ticker, not a per-span flush triggered independently by that
+// span's own buffered size or time-since-last-flush: the writer exposes no
+// API to flush one span's buffer in isolation from the rest. Best-effort
+// mode changes whether GetMinResolvedTs is updated, not how often or how
+// independently data actually reaches the writer.
+func (m *ManagerImpl) flushLog(
+	ctx context.Context, handleErr func(err error), workTimeSlice *time.Duration,
+) {
+	start := time.Now()
+	defer func() {
+		*workTimeSlice += time.Since(start)
+	}()
+
+	_, minTs := m.prepareForFlush()
+	bestEffort := m.shouldUseBestEffort(minTs)
+	if bestEffort {
+		atomic.StoreInt32(&m.mode, int32(bestEffortMode))
+		flushModeGauge.WithLabelValues(m.changeFeedID.Namespace, m.changeFeedID.ID).Set(1)
+	} else {
+		atomic.StoreInt32(&m.mode, int32(consistentMode))
+		flushModeGauge.WithLabelValues(m.changeFeedID.Namespace, m.changeFeedID.ID).Set(0)
+	}
+
+	if err := m.writer.FlushLog(ctx); err != nil {
+		handleErr(errors.Trace(err))
+		return
+	}
+
+	if bestEffort {
+		flushBestEffortCount.WithLabelValues(m.changeFeedID.Namespace, m.changeFeedID.ID).Inc()
+		return
+	}
+
+	tables, flushedMinTs := m.prepareForFlush()
+	m.postFlush(tables, flushedMinTs)
+}
+
+// shouldUseBestEffort decides the flush mode for the current tick. It is
+// driven off m.clock so tests can inject a fake clock instead of sleeping.
+func (m *ManagerImpl) shouldUseBestEffort(minResolvedTs uint64) bool {
+	if m.cfg == nil {
+		return false
+	}
+	if m.cfg.BestEffortOnly {
+		return true
+	}
+	if m.cfg.BestEffortWindow <= 0 {
+		return false
+	}
+	if minResolvedTs == 0 || minResolvedTs == uint64(math.MaxInt64) {
+		return false
+	}
+	now := time.Now()
+	if m.clock != nil {
+		now = m.clock()
+	}
+	resolvedTime := oracle.GetTimeFromTS(minResolvedTs)
+	return now.Sub(resolvedTime) > m.cfg.BestEffortWindow
+}
+
+// bgUpdateLog is the background goroutine that periodically flushes
+// buffered events and maintains the manager's global resolved ts.
+func (m *ManagerImpl) bgUpdateLog(ctx context.Context, flushIntervalInMs int64, errCh chan<- error) error {
+	ticker := time.NewTicker(time.Duration(flushIntervalInMs) * time.Millisecond)
+	defer ticker.Stop()
+
+	var workTimeSlice time.Duration
+	handleErr := func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case cache := <-m.logBuffer.Out():
+			switch cache.eventType {
+			case model.MessageTypeRow:
+				if err := m.writer.WriteLog(ctx, cache.span, cache.rows); err != nil {
+					err = errors.Trace(err)
+					handleErr(err)
+					return err
+				}
+			case model.MessageTypeResolved:
+				m.onResolvedTsMsg(cache.span, model.Ts(cache.resolvedTs))
+			}
+		case respCh := <-m.drainReq:
+			// Serviced here rather than by the requesting goroutine, so
+			// logBuffer and the writer always have a single consumer.
+			respCh <- m.drainBuffered(ctx)
+		case <-ticker.C:
+			m.flushLog(ctx, handleErr, &workTimeSlice)
+		}
+	}
+}
@@ -31,6 +31,7 @@ import (
 	"github.com/pingcap/tiflow/pkg/redo"
 	"github.com/pingcap/tiflow/pkg/spanz"
 	"github.com/stretchr/testify/require"
+	"github.com/tikv/client-go/v2/oracle"
 	"go.uber.org/zap"
 )
 
@@ -176,6 +177,30 @@ func TestLogManagerInProcessor(t *testing.T) {
 		require.Nil(t, err)
 	}
 	checkResolvedTs(logMgr, flushResolvedTs)
+
+	// check a bounded [MinTimestamp, MaxTimestamp] replay window: events
+	// older than MinTimestamp are dropped silently, events newer than
+	// MaxTimestamp are rejected as back-pressure, and UpdateResolvedTs is
+	// clamped to MaxTimestamp.
+	require.Nil(t, logMgr.SetTimestampRange(model.Ts(210), model.Ts(250)))
+
+	underRangeRow := &model.RowChangedEvent{CommitTs: 205, Table: &model.TableName{TableID: 53}}
+	err = logMgr.EmitRowChangedEvents(ctx, spans[0], nil, underRangeRow)
+	require.Nil(t, err)
+
+	overRangeRow := &model.RowChangedEvent{CommitTs: 300, Table: &model.TableName{TableID: 53}}
+	err = logMgr.EmitRowChangedEvents(ctx, spans[0], nil, overRangeRow)
+	require.ErrorIs(t, err, ErrRedoTsExceedsMax)
+
+	for _, span := range spans {
+		err := logMgr.UpdateResolvedTs(ctx, span, 300)
+		require.Nil(t, err)
+	}
+	checkResolvedTs(logMgr, 250)
+	require.LessOrEqual(t, logMgr.GetMinResolvedTs(), uint64(250))
+
+	// Clear the bound for any further use of logMgr by other subtests.
+	require.Nil(t, logMgr.SetTimestampRange(0, 0))
 }
 
 // TestLogManagerInOwner tests how redo log manager is used in owner,
@@ -392,6 +417,138 @@ func TestManagerError(t *testing.T) {
 	}
 }
 
+// TestManagerBestEffortMode tests that the manager switches into best-effort
+// mode once the slowest span falls behind wall-clock time by more than
+// BestEffortWindow, and flips back once the window closes. The clock is
+// injected so the test does not depend on real time passing.
+func TestManagerBestEffortMode(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cfg := &config.ConsistentConfig{
+		Level:             string(redo.ConsistentLevelEventual),
+		Storage:           "blackhole://",
+		FlushIntervalInMs: config.DefaultFlushIntervalInMs,
+		BestEffortWindow:  time.Minute,
+	}
+	errCh := make(chan error, 1)
+	opts := newMockManagerOptions(errCh)
+	opts.EnableBgRunner = false
+	logMgr, err := NewManager(ctx, cfg, opts)
+	require.Nil(t, err)
+	defer logMgr.Cleanup(ctx)
+
+	span := spanz.TableIDToComparableSpan(1)
+	now := time.Now()
+	logMgr.clock = func() time.Time { return now }
+	logMgr.AddTable(span, oracle.GoTimeToTS(now))
+
+	var workTimeSlice time.Duration
+	logMgr.flushLog(ctx, func(err error) { errCh <- err }, &workTimeSlice)
+	require.False(t, logMgr.IsBestEffortMode())
+
+	// Advance the injected clock well past the best-effort window: the
+	// laggard span should now push the manager into best-effort mode.
+	logMgr.clock = func() time.Time { return now.Add(2 * time.Minute) }
+	logMgr.flushLog(ctx, func(err error) { errCh <- err }, &workTimeSlice)
+	require.True(t, logMgr.IsBestEffortMode())
+
+	// Once the laggard span catches up, the manager flips back.
+	logMgr.onResolvedTsMsg(span, oracle.GoTimeToTS(now.Add(2*time.Minute)))
+	logMgr.flushLog(ctx, func(err error) { errCh <- err }, &workTimeSlice)
+	require.False(t, logMgr.IsBestEffortMode())
+}
+
+// TestManagerBestEffortWindowDisabled checks that a zero/disabled
+// BestEffortWindow preserves the existing consistent-mode guarantee that
+// GetMinResolvedTs is always gated by the slowest span.
+func TestManagerBestEffortWindowDisabled(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logMgr, err := NewMockManager(ctx)
+	require.Nil(t, err)
+	defer logMgr.Cleanup(ctx)
+
+	span := spanz.TableIDToComparableSpan(1)
+	logMgr.clock = func() time.Time { return time.Now().Add(24 * time.Hour) }
+	logMgr.AddTable(span, model.Ts(100))
+
+	var workTimeSlice time.Duration
+	logMgr.flushLog(ctx, func(err error) {}, &workTimeSlice)
+	require.False(t, logMgr.IsBestEffortMode())
+	require.Equal(t, uint64(100), logMgr.GetMinResolvedTs())
+}
+
+// TestManagerSnapshotHoldsConcurrentEmit tests that EmitRowChangedEvents
+// for a span is held while a snapshot is prepared for that span, and is
+// released once the snapshot is committed.
+func TestManagerSnapshotHoldsConcurrentEmit(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logMgr, err := NewMockManager(ctx)
+	require.Nil(t, err)
+	defer logMgr.Cleanup(ctx)
+
+	span := spanz.TableIDToComparableSpan(1)
+	logMgr.AddTable(span, model.Ts(100))
+
+	handle, err := logMgr.PrepareSnapshot(ctx, "snap-1")
+	require.Nil(t, err)
+	require.Nil(t, logMgr.WaitPrepared(ctx, handle))
+
+	emitDone := make(chan error, 1)
+	go func() {
+		emitDone <- logMgr.EmitRowChangedEvents(ctx, span, nil,
+			&model.RowChangedEvent{CommitTs: 150, Table: &model.TableName{TableID: 1}})
+	}()
+
+	select {
+	case <-emitDone:
+		t.Fatal("EmitRowChangedEvents should be held while the snapshot is prepared")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.Nil(t, logMgr.CommitSnapshot(handle))
+	select {
+	case err := <-emitDone:
+		require.Nil(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("EmitRowChangedEvents should unblock once the snapshot is committed")
+	}
+}
+
+// TestManagerSnapshotAbortLeavesRtsMapUnchanged tests that aborting a
+// snapshot neither mutates rtsMap nor leaves the manager frozen.
+func TestManagerSnapshotAbortLeavesRtsMapUnchanged(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	logMgr, err := NewMockManager(ctx)
+	require.Nil(t, err)
+	defer logMgr.Cleanup(ctx)
+
+	span := spanz.TableIDToComparableSpan(1)
+	logMgr.AddTable(span, model.Ts(100))
+	before := logMgr.GetMinResolvedTs()
+
+	handle, err := logMgr.PrepareSnapshot(ctx, "snap-2")
+	require.Nil(t, err)
+	require.Nil(t, logMgr.AbortSnapshot(handle))
+
+	require.Equal(t, before, logMgr.GetMinResolvedTs())
+	require.False(t, logMgr.frozen.Load())
+
+	err = logMgr.EmitRowChangedEvents(ctx, span, nil,
+		&model.RowChangedEvent{CommitTs: 150, Table: &model.TableName{TableID: 1}})
+	require.Nil(t, err)
+}
+
 func TestReuseWritter(t *testing.T) {
 	ctxs := make([]context.Context, 0, 2)
 	cancels := make([]func(), 0, 2)
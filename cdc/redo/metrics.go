@@ -0,0 +1,40 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redo
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	flushBestEffortCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "ticdc",
+			Subsystem: "redo",
+			Name:      "flush_best_effort_count",
+			Help:      "Counter of flushLog ticks that ran in best-effort mode.",
+		}, []string{"namespace", "changefeed"})
+
+	flushModeGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "ticdc",
+			Subsystem: "redo",
+			Name:      "flush_mode",
+			Help:      "Current redo flush mode, 0 for consistent and 1 for best-effort.",
+		}, []string{"namespace", "changefeed"})
+)
+
+// InitMetrics registers all metrics defined in this file.
+func InitMetrics(registry *prometheus.Registry) {
+	registry.MustRegister(flushBestEffortCount)
+	registry.MustRegister(flushModeGauge)
+}
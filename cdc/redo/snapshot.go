@@ -0,0 +1,326 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package redo
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tiflow/cdc/model"
+	"github.com/pingcap/tiflow/cdc/processor/tablepb"
+	"github.com/pingcap/tiflow/pkg/spanz"
+	"go.uber.org/zap"
+)
+
+// snapshotMetaWriter is implemented by redo log writer backends that can
+// persist a small named blob alongside the redo files themselves, e.g. to the
+// same storage the redo logs are written to. Not every writer.RedoLogWriter
+// implementation supports this, so manifest persistence type-asserts m.writer
+// against it and degrades to an in-memory-only checkpoint when unsupported,
+// rather than widening the writer.RedoLogWriter interface for every backend.
+type snapshotMetaWriter interface {
+	FlushMeta(ctx context.Context, name string, data []byte) error
+	ReadMeta(ctx context.Context, name string) ([]byte, error)
+}
+
+// manifestPayload is the JSON-serialized form of a snapshotManifest.
+type manifestPayload struct {
+	ID         string              `json:"id"`
+	CreateTime time.Time           `json:"create-time"`
+	RtsMap     map[string]model.Ts `json:"rts-map"`
+}
+
+// manifestName derives the meta file name a manifest is persisted under from
+// its snapshot id.
+func manifestName(id string) string {
+	return "snapshot-" + id + ".meta"
+}
+
+// persistManifest writes manifest's rtsMap and metadata to storage alongside
+// the redo files, via m.writer, so a different process can recover it later
+// with LoadCheckpoint. If the configured writer doesn't support persisting
+// metadata, the manifest stays an in-memory-only checkpoint and this is
+// logged, not treated as a fatal error: PrepareSnapshot should still succeed
+// against writer backends that can't persist a manifest.
+func (m *ManagerImpl) persistManifest(ctx context.Context, manifest *snapshotManifest) error {
+	metaWriter, ok := m.writer.(snapshotMetaWriter)
+	if !ok {
+		log.Warn("redo manager: writer does not support persisting a snapshot manifest, "+
+			"checkpoint will not survive a process restart",
+			zap.String("namespace", m.changeFeedID.Namespace),
+			zap.String("changefeed", m.changeFeedID.ID), zap.String("snapshot", manifest.id))
+		return nil
+	}
+
+	rtsMap := make(map[string]model.Ts)
+	manifest.rtsMap.Range(func(span tablepb.Span, ts model.Ts) bool {
+		rtsMap[span.String()] = ts
+		return true
+	})
+	data, err := json.Marshal(manifestPayload{
+		ID:         manifest.id,
+		CreateTime: manifest.createTime,
+		RtsMap:     rtsMap,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(metaWriter.FlushMeta(ctx, manifestName(manifest.id), data))
+}
+
+// LoadCheckpoint recovers the per-span rtsMap persisted by a prior
+// PrepareSnapshot for the given snapshot id, whether that snapshot was then
+// committed or aborted, so a
+// different process can resume from it, e.g. after restoring the paired
+// external volume snapshot. It returns an error if the configured writer
+// doesn't support persisted manifests or no manifest was found under id.
+func (m *ManagerImpl) LoadCheckpoint(ctx context.Context, id string) (map[string]model.Ts, error) {
+	metaWriter, ok := m.writer.(snapshotMetaWriter)
+	if !ok {
+		return nil, errors.New("redo manager: writer does not support persisted snapshot manifests")
+	}
+	data, err := metaWriter.ReadMeta(ctx, manifestName(id))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var payload manifestPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return payload.RtsMap, nil
+}
+
+// LastCheckpoint returns the id of the most recently committed snapshot
+// manifest, if any.
+func (m *ManagerImpl) LastCheckpoint() (string, bool) {
+	m.snapshotMu.Lock()
+	defer m.snapshotMu.Unlock()
+	if m.lastCheckpoint == nil {
+		return "", false
+	}
+	return m.lastCheckpoint.id, true
+}
+
+// SnapshotHandle identifies a redo frontier captured by PrepareSnapshot. It
+// is opaque to callers and must be passed back unmodified to WaitPrepared,
+// CommitSnapshot or AbortSnapshot.
+type SnapshotHandle struct {
+	id       string
+	manifest *snapshotManifest
+	doneCh   chan struct{}
+}
+
+// snapshotManifest records the redo frontier captured while the manager was
+// frozen. PrepareSnapshot persists it via persistManifest so a different
+// process can recover it with LoadCheckpoint, and CommitSnapshot installs it
+// as the manager's own in-memory lastCheckpoint.
+type snapshotManifest struct {
+	id         string
+	createTime time.Time
+	rtsMap     *spanz.HashMap[model.Ts]
+}
+
+// PrepareSnapshot freezes the manager at its current per-span frontier: new
+// EmitRowChangedEvents/UpdateResolvedTs calls that would advance a span past
+// its captured max ts are held until CommitSnapshot or AbortSnapshot
+// releases them. It drains logBuffer and forces a full flush so the
+// returned handle's manifest reflects a durable, globally consistent
+// frontier suitable for pairing with an external volume snapshot.
+func (m *ManagerImpl) PrepareSnapshot(ctx context.Context, id string) (SnapshotHandle, error) {
+	if !m.Enabled() || m.writer == nil {
+		return SnapshotHandle{}, errors.New("redo manager: PrepareSnapshot requires redo to be enabled")
+	}
+
+	m.snapshotMu.Lock()
+	if m.frozen.Load() {
+		m.snapshotMu.Unlock()
+		return SnapshotHandle{}, errors.New("redo manager: a snapshot is already in progress")
+	}
+
+	ceiling := spanz.NewHashMap[model.Ts]()
+	m.rtsMapMu.RLock()
+	m.rtsMap.Range(func(span tablepb.Span, ts model.Ts) bool {
+		ceiling.ReplaceOrInsert(span, ts)
+		return true
+	})
+	m.rtsMapMu.RUnlock()
+
+	m.freezeCeiling = ceiling
+	m.frozenCh = make(chan struct{})
+	m.frozen.Store(true)
+	m.snapshotMu.Unlock()
+
+	// Drain through drainAndFlush rather than holding snapshotMu here: it
+	// hands the drain off to bgUpdateLog, the sole owner of logBuffer and
+	// the writer, and waiting for that hand-off while holding snapshotMu
+	// would deadlock against onResolvedTsMsg's own snapshotMu use.
+	if err := m.drainAndFlush(ctx); err != nil {
+		m.snapshotMu.Lock()
+		m.unfreezeLocked()
+		m.snapshotMu.Unlock()
+		return SnapshotHandle{}, errors.Trace(err)
+	}
+
+	manifest := &snapshotManifest{id: id, createTime: time.Now(), rtsMap: ceiling}
+
+	if err := m.persistManifest(ctx, manifest); err != nil {
+		m.snapshotMu.Lock()
+		m.unfreezeLocked()
+		m.snapshotMu.Unlock()
+		return SnapshotHandle{}, errors.Trace(err)
+	}
+
+	log.Info("redo manager prepared a snapshot",
+		zap.String("namespace", m.changeFeedID.Namespace),
+		zap.String("changefeed", m.changeFeedID.ID), zap.String("snapshot", id))
+	return SnapshotHandle{id: id, manifest: manifest, doneCh: m.frozenCh}, nil
+}
+
+// drainAndFlush flushes any events already buffered in logBuffer through the
+// writer and forces a full flush. When bgUpdateLog is running it owns
+// logBuffer and the writer, so the drain is handed off to it over drainReq
+// instead of being performed here, which would race bgUpdateLog's own reads
+// of the same channel and its own calls into the writer.
+func (m *ManagerImpl) drainAndFlush(ctx context.Context) error {
+	if !m.bgRunnerEnabled {
+		return errors.Trace(m.drainBuffered(ctx))
+	}
+
+	respCh := make(chan error, 1)
+	select {
+	case m.drainReq <- respCh:
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+	select {
+	case err := <-respCh:
+		return errors.Trace(err)
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+}
+
+// drainBuffered drains any buffered cache events through the writer and
+// forces a full flush. It must only run on the goroutine that otherwise
+// owns logBuffer and the writer: bgUpdateLog, or drainAndFlush itself when
+// no background runner is active.
+func (m *ManagerImpl) drainBuffered(ctx context.Context) error {
+	for {
+		select {
+		case cache := <-m.logBuffer.Out():
+			switch cache.eventType {
+			case model.MessageTypeRow:
+				if err := m.writer.WriteLog(ctx, cache.span, cache.rows); err != nil {
+					return errors.Trace(err)
+				}
+			case model.MessageTypeResolved:
+				m.onResolvedTsMsg(cache.span, model.Ts(cache.resolvedTs))
+			}
+		default:
+			return errors.Trace(m.writer.FlushLog(ctx))
+		}
+	}
+}
+
+// WaitPrepared blocks until the redo frontier captured by handle is durable.
+// PrepareSnapshot already drains and flushes synchronously, so this returns
+// at once: nil, or ctx's error if ctx is already done. It does not check
+// whether handle has since been committed or aborted.
+func (m *ManagerImpl) WaitPrepared(ctx context.Context, handle SnapshotHandle) error {
+	if !m.Enabled() || m.writer == nil {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	default:
+		return nil
+	}
+}
+
+// CommitSnapshot unfreezes the manager and records the handle's manifest as
+// the manager's own last checkpoint, queryable via LastCheckpoint. The
+// manifest itself was already persisted by PrepareSnapshot, so a different
+// process can recover it via LoadCheckpoint even without this local record.
+func (m *ManagerImpl) CommitSnapshot(handle SnapshotHandle) error {
+	if !m.Enabled() || m.writer == nil {
+		return nil
+	}
+
+	m.snapshotMu.Lock()
+	defer m.snapshotMu.Unlock()
+
+	if !m.frozen.Load() || m.frozenCh != handle.doneCh {
+		return errors.New("redo manager: no matching snapshot is in progress")
+	}
+	m.lastCheckpoint = handle.manifest
+	m.unfreezeLocked()
+	return nil
+}
+
+// AbortSnapshot unfreezes the manager without recording the handle's
+// manifest as the last checkpoint; rtsMap is left exactly as it was before
+// PrepareSnapshot, since preparing a snapshot never mutates it. The manifest
+// PrepareSnapshot already persisted is not removed from storage, so
+// LoadCheckpoint can still read it after an abort.
+func (m *ManagerImpl) AbortSnapshot(handle SnapshotHandle) error {
+	if !m.Enabled() || m.writer == nil {
+		return nil
+	}
+
+	m.snapshotMu.Lock()
+	defer m.snapshotMu.Unlock()
+
+	if !m.frozen.Load() || m.frozenCh != handle.doneCh {
+		return errors.New("redo manager: no matching snapshot is in progress")
+	}
+	m.unfreezeLocked()
+	return nil
+}
+
+// unfreezeLocked clears the freeze state and releases any callers blocked in
+// waitIfFrozen. m.snapshotMu must be held by the caller.
+func (m *ManagerImpl) unfreezeLocked() {
+	m.frozen.Store(false)
+	m.freezeCeiling = nil
+	close(m.frozenCh)
+	m.frozenCh = nil
+}
+
+// waitIfFrozen blocks the caller if the manager is frozen and ts would
+// advance span past its captured snapshot ceiling, until the in-progress
+// snapshot is committed or aborted.
+func (m *ManagerImpl) waitIfFrozen(ctx context.Context, span tablepb.Span, ts model.Ts) error {
+	m.snapshotMu.Lock()
+	if !m.frozen.Load() {
+		m.snapshotMu.Unlock()
+		return nil
+	}
+	ceiling, _ := m.freezeCeiling.Get(span)
+	ch := m.frozenCh
+	m.snapshotMu.Unlock()
+
+	if ts <= ceiling {
+		return nil
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	}
+}
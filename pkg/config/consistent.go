@@ -0,0 +1,48 @@
+// Copyright 2021 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import "time"
+
+// DefaultFlushIntervalInMs is the default flush interval for redo log.
+const DefaultFlushIntervalInMs = 2000
+
+// ConsistentConfig represents replication consistency config for a changefeed.
+type ConsistentConfig struct {
+	Level             string `toml:"level" json:"level"`
+	MaxLogSize        int64  `toml:"max-log-size" json:"max-log-size"`
+	FlushIntervalInMs int64  `toml:"flush-interval" json:"flush-interval"`
+	Storage           string `toml:"storage" json:"storage"`
+	UseFileBackend    bool   `toml:"use-file-backend" json:"use-file-backend"`
+	Compression       string `toml:"compression" json:"compression"`
+
+	// BestEffortWindow, once a redo manager's slowest span falls this far
+	// behind wall-clock time, switches the manager into best-effort mode, in
+	// which its flushes stop updating the value GetMinResolvedTs reports;
+	// per-span resolved ts keep advancing internally. The underlying flush
+	// against the writer is unaffected: it is still a single batched flush
+	// across all spans on bgUpdateLog's ticker. Zero disables best-effort
+	// mode.
+	BestEffortWindow time.Duration `toml:"best-effort-window" json:"best-effort-window"`
+	// BestEffortOnly forces every flush into best-effort mode, regardless of
+	// BestEffortWindow.
+	BestEffortOnly bool `toml:"best-effort-only" json:"best-effort-only"`
+
+	// MinTimestamp and MaxTimestamp bound the inclusive [min, max] CommitTs
+	// window a redo manager will accept events for, e.g. when replaying an
+	// existing set of redo files into a downstream sink. Zero means
+	// unbounded on that side.
+	MinTimestamp uint64 `toml:"min-timestamp" json:"min-timestamp"`
+	MaxTimestamp uint64 `toml:"max-timestamp" json:"max-timestamp"`
+}
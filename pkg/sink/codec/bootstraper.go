@@ -0,0 +1,623 @@
+// Copyright 2022 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package codec
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/log"
+	timodel "github.com/pingcap/tidb/pkg/parser/model"
+	"github.com/pingcap/tiflow/cdc/model"
+	"github.com/pingcap/tiflow/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultInputChanSize is the buffer size of a bootstrapWorker's input channel.
+	defaultInputChanSize = 1024
+	// defaultSendBootstrapInterval is the default interval to resend a bootstrap
+	// message for a table, even if nothing about it has changed.
+	defaultSendBootstrapInterval = 120 * time.Second
+	// defaultSendBootstrapInMsgCount is the default number of row events after
+	// which a bootstrap message is resent for a table.
+	defaultSendBootstrapInMsgCount int32 = 10000
+	// defaultMaxInactiveDuration is how long a table can go without receiving
+	// any row event before it's pruned from the worker.
+	defaultMaxInactiveDuration = 30 * time.Minute
+	// defaultCheckInterval is how often the worker scans for tables that
+	// have gone inactive.
+	defaultCheckInterval = time.Second
+
+	// bootstrapBatchInterval bounds how long eligible tables are accumulated
+	// before a batched bootstrap envelope is flushed for a topic.
+	bootstrapBatchInterval = 200 * time.Millisecond
+	// defaultMaxBatchSize caps the number of tables combined into a single
+	// batched bootstrap envelope.
+	defaultMaxBatchSize = 512
+	// defaultMaxBatchBytes caps the approximate serialized size of a single
+	// batched bootstrap envelope.
+	defaultMaxBatchBytes = 4 * 1024 * 1024
+
+	// defaultFullBootstrapInterval bounds how long a table can go between
+	// Full bootstrap messages, even if every intervening message could have
+	// been sent as a Delta. This re-syncs any consumer that silently lost
+	// its base version.
+	defaultFullBootstrapInterval = 24 * time.Hour
+)
+
+// TopicPartitionKey contains the topic and partition a row event was routed to.
+type TopicPartitionKey struct {
+	Topic          string
+	Partition      int32
+	TotalPartition int32
+}
+
+// BootstrapKind distinguishes a full bootstrap message from one carrying
+// only the schema changes relative to a previously broadcast version.
+type BootstrapKind int
+
+const (
+	// BootstrapKindFull carries the complete TableInfo for each table.
+	BootstrapKindFull BootstrapKind = iota
+	// BootstrapKindDelta carries only the column changes relative to the
+	// base version the consumer is assumed to already have.
+	BootstrapKindDelta
+)
+
+// columnChange describes how a single column changed between two versions
+// of a table's schema.
+type columnChange struct {
+	Kind   string // "add", "drop", or "type-change"
+	Column string
+}
+
+// schemaDelta is the payload of a BootstrapKindDelta bootstrap message.
+type schemaDelta struct {
+	// BaseUpdateTS is the UpdateTS of the version Changes is relative to, so
+	// the consumer can detect it doesn't hold that base and request a Full
+	// bootstrap instead.
+	BaseUpdateTS uint64
+	Changes      []columnChange
+}
+
+// future represents a bootstrap message to be encoded and sent. TableInfos
+// has exactly one entry for a per-table Full message, none for a Delta
+// message (which carries only Delta), and one or more for a batched
+// bootstrap envelope. Kind and Delta only apply to single-table
+// messages: batched envelopes are always BootstrapKindFull.
+type future struct {
+	Key        TopicPartitionKey
+	TableInfos []*model.TableInfo
+	Kind       BootstrapKind
+	Delta      *schemaDelta
+	Done       chan struct{}
+}
+
+// BatchBootstrapBuilder is implemented by encoder builders that can encode a
+// single envelope carrying more than one table's TableInfo. Builders that do
+// not implement it (or return false) fall back to one bootstrap message per
+// table.
+type BatchBootstrapBuilder interface {
+	RowEventEncoderBuilder
+	// SupportsBatchBootstrap reports whether the built encoder can encode a
+	// batched bootstrap envelope.
+	SupportsBatchBootstrap() bool
+}
+
+// DeltaBootstrapBuilder is implemented by encoder builders that can encode a
+// BootstrapKindDelta message. Builders that do not implement it (or return
+// false) always receive BootstrapKindFull messages.
+type DeltaBootstrapBuilder interface {
+	RowEventEncoderBuilder
+	// SupportsDeltaBootstrap reports whether the built encoder can encode a
+	// delta bootstrap message.
+	SupportsDeltaBootstrap() bool
+}
+
+// tableInfoHistorySize is how many previously sent TableInfo versions a
+// tableStatus keeps, to diff the current version against the most recent one
+// and to detect whether a consumer-reported base version is still held.
+const tableInfoHistorySize = 3
+
+// tableStatus tracks when a table last sent/received a message, to decide
+// whether it is due for a bootstrap message and whether it is still active.
+type tableStatus struct {
+	id TopicPartitionKey
+
+	tableInfo atomic.Value // *model.TableInfo
+
+	counter             atomic.Int32
+	lastSendTime        atomic.Value // time.Time
+	lastMsgReceivedTime atomic.Value // time.Time
+	lastFullSendTime    atomic.Value // time.Time
+
+	// needsFull is set when a consumer reports it doesn't hold the base
+	// version a delta would be relative to, forcing the next message to be
+	// a Full bootstrap regardless of fullBootstrapInterval.
+	needsFull atomic.Bool
+
+	// queued is set while the table has already been appended to a pending
+	// batch, so further qualifying row events before that batch flushes
+	// update its tracked TableInfo in place instead of re-appending it.
+	queued atomic.Bool
+
+	historyMu sync.Mutex
+	// history holds up to tableInfoHistorySize of the most recently sent
+	// TableInfo versions, oldest first, as a ring buffer.
+	history []*model.TableInfo
+	// resyncBase, when non-nil, overrides which retained version the next
+	// Delta message diffs against. It's set by NotifyUnknownBaseVersion
+	// when the version a consumer reports as its actual base is still in
+	// history, and cleared once the next message is sent.
+	resyncBase *model.TableInfo
+}
+
+func newTableStatus(key TopicPartitionKey, row *model.RowChangedEvent) *tableStatus {
+	t := &tableStatus{id: key}
+	t.tableInfo.Store(row.TableInfo)
+	t.lastSendTime.Store(time.Time{})
+	t.lastFullSendTime.Store(time.Time{})
+	t.lastMsgReceivedTime.Store(time.Now())
+	return t
+}
+
+// lastSentInfo returns the most recently sent TableInfo, or nil if the table
+// has never been sent a bootstrap message.
+func (t *tableStatus) lastSentInfo() *model.TableInfo {
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	if len(t.history) == 0 {
+		return nil
+	}
+	return t.history[len(t.history)-1]
+}
+
+// pushSentInfo records info as the most recently sent version, evicting the
+// oldest entry once the ring buffer is full, and clears any pending
+// resyncBase now that a message diffed against it has gone out.
+func (t *tableStatus) pushSentInfo(info *model.TableInfo) {
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	t.history = append(t.history, info)
+	if len(t.history) > tableInfoHistorySize {
+		t.history = t.history[len(t.history)-tableInfoHistorySize:]
+	}
+	t.resyncBase = nil
+}
+
+// findSentInfo returns the retained history entry whose UpdateTS equals
+// updateTS, or nil if that version is no longer retained.
+func (t *tableStatus) findSentInfo(updateTS uint64) *model.TableInfo {
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	for i := len(t.history) - 1; i >= 0; i-- {
+		if t.history[i].UpdateTS == updateTS {
+			return t.history[i]
+		}
+	}
+	return nil
+}
+
+// diffBase returns the TableInfo the next Delta message should diff
+// against: resyncBase, if NotifyUnknownBaseVersion set one, otherwise the
+// most recently sent version.
+func (t *tableStatus) diffBase() *model.TableInfo {
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	if t.resyncBase != nil {
+		return t.resyncBase
+	}
+	if len(t.history) == 0 {
+		return nil
+	}
+	return t.history[len(t.history)-1]
+}
+
+// shouldSendBootstrapMsg returns whether the table should be sent a bootstrap
+// message: it has never been sent one, it has received enough row events
+// since the last one, or enough time has elapsed since the last one.
+func (t *tableStatus) shouldSendBootstrapMsg(
+	sendBootstrapInterval time.Duration, sendBootstrapInMsgCount int32,
+) bool {
+	last := t.lastSendTime.Load().(time.Time)
+	if last.IsZero() {
+		return true
+	}
+	if t.counter.Load() >= sendBootstrapInMsgCount {
+		return true
+	}
+	return time.Since(last) >= sendBootstrapInterval
+}
+
+// isActive returns whether the table has received a row event recently.
+func (t *tableStatus) isActive(maxInactiveDuration time.Duration) bool {
+	last := t.lastMsgReceivedTime.Load().(time.Time)
+	return time.Since(last) < maxInactiveDuration
+}
+
+// update refreshes the table's tracked state on receiving a new row event.
+func (t *tableStatus) update(key TopicPartitionKey, row *model.RowChangedEvent) {
+	t.id = key
+	t.tableInfo.Store(row.TableInfo)
+	t.counter.Add(1)
+	t.lastMsgReceivedTime.Store(time.Now())
+}
+
+// setResyncBase overrides the version the next Delta message diffs against.
+func (t *tableStatus) setResyncBase(info *model.TableInfo) {
+	t.historyMu.Lock()
+	defer t.historyMu.Unlock()
+	t.resyncBase = info
+}
+
+// markSent resets the table's bootstrap bookkeeping after a message of the
+// given kind carrying info is sent.
+func (t *tableStatus) markSent(kind BootstrapKind, info *model.TableInfo) {
+	t.counter.Store(0)
+	now := time.Now()
+	t.lastSendTime.Store(now)
+	if kind == BootstrapKindFull {
+		t.lastFullSendTime.Store(now)
+	}
+	t.pushSentInfo(info)
+}
+
+// computeSchemaDelta diffs cur against prev, returning the column adds,
+// drops and type changes relative to prev.
+func computeSchemaDelta(prev, cur *model.TableInfo) *schemaDelta {
+	delta := &schemaDelta{BaseUpdateTS: prev.UpdateTS}
+
+	prevCols := make(map[string]*timodel.ColumnInfo, len(prev.Columns))
+	for _, col := range prev.Columns {
+		prevCols[col.Name.O] = col
+	}
+	curNames := make(map[string]struct{}, len(cur.Columns))
+	for _, col := range cur.Columns {
+		curNames[col.Name.O] = struct{}{}
+		prevCol, ok := prevCols[col.Name.O]
+		if !ok {
+			delta.Changes = append(delta.Changes, columnChange{Kind: "add", Column: col.Name.O})
+			continue
+		}
+		if prevCol.FieldType.GetType() != col.FieldType.GetType() {
+			delta.Changes = append(delta.Changes, columnChange{Kind: "type-change", Column: col.Name.O})
+		}
+	}
+	for name := range prevCols {
+		if _, ok := curNames[name]; !ok {
+			delta.Changes = append(delta.Changes, columnChange{Kind: "drop", Column: name})
+		}
+	}
+	return delta
+}
+
+// statusKey identifies a table within a single topic.
+type statusKey struct {
+	topic   string
+	tableID int64
+}
+
+// bootstrapEvent is the internal message fed into bootstrapWorker.run by addEvent.
+type bootstrapEvent struct {
+	key TopicPartitionKey
+	row *model.RowChangedEvent
+}
+
+// pendingBatch accumulates tables eligible for a batched bootstrap envelope
+// on a single topic, until bootstrapBatchInterval elapses or a size limit is hit.
+type pendingBatch struct {
+	key     TopicPartitionKey
+	tables  []*tableStatus
+	bytes   int
+}
+
+// bootstrapWorker tracks per-table state and emits bootstrap messages,
+// carrying a table's TableInfo, on a schedule driven by shouldSendBootstrapMsg.
+// Eligible tables on the same topic are combined into a single batched
+// envelope when the encoder builder opts in, which keeps the number of
+// bootstrap messages proportional to the number of partitions rather than
+// the number of tables for changefeeds with many tables.
+type bootstrapWorker struct {
+	outCh                   chan *future
+	builder                 RowEventEncoderBuilder
+	batchBuilder            BatchBootstrapBuilder // nil if builder doesn't opt in
+	deltaBuilder            DeltaBootstrapBuilder // nil if builder doesn't opt in
+	sendBootstrapInterval   time.Duration
+	sendBootstrapInMsgCount int32
+	maxInactiveDuration     time.Duration
+	maxBatchSize            int
+	maxBatchBytes           int
+	fullBootstrapInterval   time.Duration
+
+	inputCh chan *bootstrapEvent
+
+	mu        sync.Mutex
+	statusMap map[statusKey]*tableStatus
+	batches   map[string]*pendingBatch
+}
+
+func newBootstrapWorker(
+	outCh chan *future,
+	builder RowEventEncoderBuilder,
+	sendBootstrapInterval time.Duration,
+	sendBootstrapInMsgCount int32,
+	maxInactiveDuration time.Duration,
+) *bootstrapWorker {
+	w := &bootstrapWorker{
+		outCh:                   outCh,
+		builder:                 builder,
+		sendBootstrapInterval:   sendBootstrapInterval,
+		sendBootstrapInMsgCount: sendBootstrapInMsgCount,
+		maxInactiveDuration:     maxInactiveDuration,
+		maxBatchSize:            defaultMaxBatchSize,
+		maxBatchBytes:           defaultMaxBatchBytes,
+		fullBootstrapInterval:   defaultFullBootstrapInterval,
+		inputCh:                 make(chan *bootstrapEvent, defaultInputChanSize),
+		statusMap:               make(map[statusKey]*tableStatus),
+		batches:                 make(map[string]*pendingBatch),
+	}
+	if bb, ok := builder.(BatchBootstrapBuilder); ok && bb.SupportsBatchBootstrap() {
+		w.batchBuilder = bb
+	}
+	if db, ok := builder.(DeltaBootstrapBuilder); ok && db.SupportsDeltaBootstrap() {
+		w.deltaBuilder = db
+	}
+	return w
+}
+
+// SetFullBootstrapInterval overrides how long a table can go between Full
+// bootstrap messages when delta bootstrap is enabled.
+func (w *bootstrapWorker) SetFullBootstrapInterval(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.fullBootstrapInterval = d
+}
+
+// NotifyUnknownBaseVersion is called when a consumer reports it doesn't
+// hold the base of a Delta message it received; baseVersion is the version
+// the consumer reports it does hold. If that version is still in the
+// table's retained history, the next Delta is computed directly against it,
+// re-syncing the consumer without a full resend, and no Full message is
+// forced; otherwise the next message falls back to Full.
+func (w *bootstrapWorker) NotifyUnknownBaseVersion(topic string, tableID int64, baseVersion uint64) {
+	w.mu.Lock()
+	status, ok := w.statusMap[statusKey{topic: topic, tableID: tableID}]
+	w.mu.Unlock()
+	if !ok {
+		return
+	}
+	if retained := status.findSentInfo(baseVersion); retained != nil {
+		status.setResyncBase(retained)
+		return
+	}
+	status.needsFull.Store(true)
+}
+
+// decideKind picks Full or Delta for status's next bootstrap message.
+func (w *bootstrapWorker) decideKind(status *tableStatus, now time.Time) BootstrapKind {
+	if w.deltaBuilder == nil {
+		return BootstrapKindFull
+	}
+	if status.needsFull.Swap(false) {
+		return BootstrapKindFull
+	}
+	if status.lastSentInfo() == nil {
+		return BootstrapKindFull
+	}
+	w.mu.Lock()
+	fullBootstrapInterval := w.fullBootstrapInterval
+	w.mu.Unlock()
+	if fullBootstrapInterval > 0 {
+		lastFull := status.lastFullSendTime.Load().(time.Time)
+		if lastFull.IsZero() || now.Sub(lastFull) >= fullBootstrapInterval {
+			return BootstrapKindFull
+		}
+	}
+	return BootstrapKindDelta
+}
+
+// addEvent queues a row event for bootstrap bookkeeping.
+func (w *bootstrapWorker) addEvent(ctx context.Context, key TopicPartitionKey, row *model.RowChangedEvent) error {
+	select {
+	case <-ctx.Done():
+		return errors.Trace(ctx.Err())
+	case w.inputCh <- &bootstrapEvent{key: key, row: row}:
+		return nil
+	}
+}
+
+// run drives the worker's main loop until ctx is cancelled.
+func (w *bootstrapWorker) run(ctx context.Context) error {
+	ticker := time.NewTicker(defaultCheckInterval)
+	defer ticker.Stop()
+
+	batchTicker := time.NewTicker(bootstrapBatchInterval)
+	defer batchTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case ev := <-w.inputCh:
+			if err := w.handleEvent(ctx, ev); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			w.pruneInactive()
+		case <-batchTicker.C:
+			if err := w.flushAllBatches(ctx); err != nil {
+				log.Warn("bootstrap worker failed to flush a batch, "+
+					"tables remain pending and will be retried", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (w *bootstrapWorker) handleEvent(ctx context.Context, ev *bootstrapEvent) error {
+	key := statusKey{topic: ev.key.Topic, tableID: ev.row.Table.TableID}
+
+	w.mu.Lock()
+	status, ok := w.statusMap[key]
+	if !ok {
+		status = newTableStatus(ev.key, ev.row)
+		w.statusMap[key] = status
+	} else {
+		status.update(ev.key, ev.row)
+	}
+	shouldSend := status.shouldSendBootstrapMsg(w.sendBootstrapInterval, w.sendBootstrapInMsgCount)
+	w.mu.Unlock()
+
+	if !shouldSend {
+		return nil
+	}
+	if w.batchBuilder == nil {
+		info := ev.row.TableInfo
+		now := time.Now()
+		kind := w.decideKind(status, now)
+		f := &future{Key: ev.key, Kind: kind}
+		if kind == BootstrapKindDelta {
+			f.Delta = computeSchemaDelta(status.diffBase(), info)
+		} else {
+			f.TableInfos = []*model.TableInfo{info}
+		}
+		if err := w.sendFuture(ctx, f); err != nil {
+			return err
+		}
+		status.markSent(kind, info)
+		return nil
+	}
+	if !status.queued.CompareAndSwap(false, true) {
+		// status is already sitting in its topic's pending batch; that
+		// batch will pick up its latest TableInfo (already updated above)
+		// when it flushes, so it must not be appended again.
+		return nil
+	}
+	return w.addToBatch(ctx, ev.key, status)
+}
+
+// addToBatch enqueues status into its topic's pending batch, flushing early
+// if the batch has hit a size or byte limit.
+func (w *bootstrapWorker) addToBatch(ctx context.Context, key TopicPartitionKey, status *tableStatus) error {
+	w.mu.Lock()
+	batch, ok := w.batches[key.Topic]
+	if !ok {
+		batch = &pendingBatch{key: key}
+		w.batches[key.Topic] = batch
+	}
+	batch.tables = append(batch.tables, status)
+	batch.bytes += approxTableInfoSize(status.tableInfo.Load().(*model.TableInfo))
+	full := len(batch.tables) >= w.maxBatchSize || batch.bytes >= w.maxBatchBytes
+	w.mu.Unlock()
+
+	if !full {
+		return nil
+	}
+	return w.flushBatch(ctx, key.Topic)
+}
+
+func (w *bootstrapWorker) flushAllBatches(ctx context.Context) error {
+	w.mu.Lock()
+	topics := make([]string, 0, len(w.batches))
+	for topic, batch := range w.batches {
+		if len(batch.tables) > 0 {
+			topics = append(topics, topic)
+		}
+	}
+	w.mu.Unlock()
+
+	for _, topic := range topics {
+		if err := w.flushBatch(ctx, topic); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushBatch emits a single combined bootstrap envelope for topic's pending
+// batch. On failure the batch is left untouched so its tables are retried on
+// the next flush, instead of being silently dropped.
+func (w *bootstrapWorker) flushBatch(ctx context.Context, topic string) error {
+	w.mu.Lock()
+	batch, ok := w.batches[topic]
+	if !ok || len(batch.tables) == 0 {
+		w.mu.Unlock()
+		return nil
+	}
+	tableInfos := make([]*model.TableInfo, 0, len(batch.tables))
+	for _, status := range batch.tables {
+		tableInfos = append(tableInfos, status.tableInfo.Load().(*model.TableInfo))
+	}
+	key := batch.key
+	w.mu.Unlock()
+
+	if err := w.sendFuture(ctx, &future{Key: key, TableInfos: tableInfos, Kind: BootstrapKindFull}); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	for _, status := range batch.tables {
+		status.markSent(BootstrapKindFull, status.tableInfo.Load().(*model.TableInfo))
+		status.queued.Store(false)
+	}
+	delete(w.batches, topic)
+	w.mu.Unlock()
+	return nil
+}
+
+// sendFuture pushes one future per partition of f.Key's topic, so every
+// partition's consumer observes the bootstrap message.
+func (w *bootstrapWorker) sendFuture(ctx context.Context, f *future) error {
+	for p := int32(0); p < f.Key.TotalPartition; p++ {
+		partitioned := &future{
+			Key:        TopicPartitionKey{Topic: f.Key.Topic, Partition: p, TotalPartition: f.Key.TotalPartition},
+			TableInfos: f.TableInfos,
+			Kind:       f.Kind,
+			Delta:      f.Delta,
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Trace(ctx.Err())
+		case w.outCh <- partitioned:
+		}
+	}
+	return nil
+}
+
+// pruneInactive removes tables that have not received a row event for
+// maxInactiveDuration, so the worker doesn't keep bootstrapping stale tables.
+func (w *bootstrapWorker) pruneInactive() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, status := range w.statusMap {
+		if !status.isActive(w.maxInactiveDuration) {
+			delete(w.statusMap, key)
+		}
+	}
+}
+
+// approxTableInfoSize estimates the serialized size of a TableInfo, used to
+// cap batched bootstrap envelopes by byte size rather than just table count.
+func approxTableInfoSize(info *model.TableInfo) int {
+	if info == nil {
+		return 0
+	}
+	size := len(info.Name.O)
+	for _, col := range info.Columns {
+		size += len(col.Name.O) + 16
+	}
+	return size
+}
@@ -132,3 +132,284 @@ func TestBootstrapWorker(t *testing.T) {
 		}
 	}
 }
+
+// mockBatchEncoderBuilder opts into the batched bootstrap path.
+type mockBatchEncoderBuilder struct {
+	MockRowEventEncoderBuilder
+}
+
+func (mockBatchEncoderBuilder) SupportsBatchBootstrap() bool { return true }
+
+// TestBootstrapWorkerBatchesManyTables tests that bootstrapping many tables
+// on the same topic at once produces O(partitions) messages, not
+// O(tables*partitions), when the encoder builder opts into batching.
+func TestBootstrapWorkerBatchesManyTables(t *testing.T) {
+	t.Parallel()
+	builder := mockBatchEncoderBuilder{}
+	outCh := make(chan *future, defaultInputChanSize)
+	worker := newBootstrapWorker(outCh, builder,
+		defaultSendBootstrapInterval, defaultSendBootstrapInMsgCount, defaultMaxInactiveDuration)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = worker.run(ctx) }()
+
+	const numTables = 1000
+	key := TopicPartitionKey{Topic: "many.tables", Partition: 0, TotalPartition: 4}
+	for i := int64(0); i < numTables; i++ {
+		row := &model.RowChangedEvent{
+			TableInfo: &model.TableInfo{TableInfo: &timodel.TableInfo{UpdateTS: 1}},
+			Table:     &model.TableName{Schema: "test", Table: "t", TableID: i},
+		}
+		require.NoError(t, worker.addEvent(ctx, key, row))
+	}
+
+	var msgCount int
+	var tablesSeen int
+	sctx, scancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer scancel()
+	for {
+		select {
+		case f := <-outCh:
+			msgCount++
+			tablesSeen += len(f.TableInfos)
+		case <-sctx.Done():
+			// A handful of batches (bounded by maxBatchSize), not one message
+			// per table: far fewer than numTables*TotalPartition messages.
+			require.Less(t, msgCount, numTables)
+			require.Equal(t, numTables*int(key.TotalPartition), tablesSeen)
+			return
+		}
+	}
+}
+
+// TestBootstrapWorkerBatchPrunesInactiveTables tests that pruning inactive
+// tables still happens while the worker is accumulating a batch.
+func TestBootstrapWorkerBatchPrunesInactiveTables(t *testing.T) {
+	t.Parallel()
+	builder := mockBatchEncoderBuilder{}
+	outCh := make(chan *future, defaultInputChanSize)
+	worker := newBootstrapWorker(outCh, builder,
+		defaultSendBootstrapInterval, defaultSendBootstrapInMsgCount, time.Millisecond)
+
+	key, row, _ := getMockTableStatus()
+	ctx := context.Background()
+	require.NoError(t, worker.handleEvent(ctx, &bootstrapEvent{key: key, row: row}))
+	time.Sleep(10 * time.Millisecond)
+
+	worker.pruneInactive()
+	worker.mu.Lock()
+	defer worker.mu.Unlock()
+	require.Empty(t, worker.statusMap)
+}
+
+// TestBootstrapWorkerBatchFailureRetainsTables tests that a failed flush
+// (here, because ctx is already cancelled when the envelope is handed to
+// outCh, which nobody reads) leaves the pending batch's
+// tables in place so they're retried on the next flush, instead of being
+// silently dropped.
+func TestBootstrapWorkerBatchFailureRetainsTables(t *testing.T) {
+	t.Parallel()
+	builder := mockBatchEncoderBuilder{}
+	outCh := make(chan *future) // unbuffered, nobody reads from it
+	worker := newBootstrapWorker(outCh, builder,
+		defaultSendBootstrapInterval, defaultSendBootstrapInMsgCount, defaultMaxInactiveDuration)
+
+	key, row, status := getMockTableStatus()
+	require.NoError(t, worker.addToBatch(context.Background(), key, status))
+
+	failCtx, failCancel := context.WithCancel(context.Background())
+	failCancel()
+	err := worker.flushBatch(failCtx, key.Topic)
+	require.Error(t, err)
+
+	worker.mu.Lock()
+	batch, ok := worker.batches[key.Topic]
+	require.True(t, ok)
+	require.Len(t, batch.tables, 1)
+	worker.mu.Unlock()
+	_ = row
+}
+
+// TestBootstrapWorkerBatchDedupsRepeatedEvents tests that several qualifying
+// row events for the same table arriving before its pending batch flushes
+// append it to the batch only once. lastSendTime/counter aren't reset until
+// markSent runs at flush time, so shouldSendBootstrapMsg keeps returning
+// true for the table in the meantime.
+func TestBootstrapWorkerBatchDedupsRepeatedEvents(t *testing.T) {
+	t.Parallel()
+	builder := mockBatchEncoderBuilder{}
+	outCh := make(chan *future, defaultInputChanSize)
+	worker := newBootstrapWorker(outCh, builder,
+		defaultSendBootstrapInterval, defaultSendBootstrapInMsgCount, defaultMaxInactiveDuration)
+
+	key, row, _ := getMockTableStatus()
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, worker.handleEvent(ctx, &bootstrapEvent{key: key, row: row}))
+	}
+
+	worker.mu.Lock()
+	batch, ok := worker.batches[key.Topic]
+	require.True(t, ok)
+	require.Len(t, batch.tables, 1)
+	worker.mu.Unlock()
+}
+
+// mockDeltaEncoderBuilder opts into the delta bootstrap path.
+type mockDeltaEncoderBuilder struct {
+	MockRowEventEncoderBuilder
+}
+
+func (mockDeltaEncoderBuilder) SupportsDeltaBootstrap() bool { return true }
+
+func tableInfoWithColumns(updateTS uint64, columnNames ...string) *model.TableInfo {
+	cols := make([]*timodel.ColumnInfo, 0, len(columnNames))
+	for _, name := range columnNames {
+		cols = append(cols, &timodel.ColumnInfo{Name: timodel.NewCIStr(name)})
+	}
+	return &model.TableInfo{
+		TableInfo: &timodel.TableInfo{UpdateTS: updateTS, Columns: cols},
+	}
+}
+
+// TestBootstrapWorkerDeltaBootstrap tests that: the first bootstrap message
+// for a table is always Full; a pure no-op UpdateTS bump (no column change)
+// emits a Delta with no changes; and a forced fullBootstrapInterval re-emits
+// Full even though nothing about the schema changed.
+func TestBootstrapWorkerDeltaBootstrap(t *testing.T) {
+	t.Parallel()
+	builder := mockDeltaEncoderBuilder{}
+	outCh := make(chan *future, defaultInputChanSize)
+	worker := newBootstrapWorker(outCh, builder, time.Millisecond, defaultSendBootstrapInMsgCount, defaultMaxInactiveDuration)
+	worker.SetFullBootstrapInterval(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = worker.run(ctx) }()
+
+	key := TopicPartitionKey{Topic: "delta.t1", Partition: 0, TotalPartition: 1}
+	table := &model.TableName{Schema: "test", Table: "t1", TableID: 1}
+
+	recv := func() *future {
+		select {
+		case f := <-outCh:
+			return f
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for a bootstrap message")
+			return nil
+		}
+	}
+
+	// case 1: first message for a table is always Full.
+	row1 := &model.RowChangedEvent{TableInfo: tableInfoWithColumns(1, "a"), Table: table}
+	require.NoError(t, worker.addEvent(ctx, key, row1))
+	f1 := recv()
+	require.Equal(t, BootstrapKindFull, f1.Kind)
+
+	// case 2: a no-op UpdateTS bump emits a Delta with no changes.
+	time.Sleep(10 * time.Millisecond) // clear shouldSendBootstrapMsg's interval gate
+	row2 := &model.RowChangedEvent{TableInfo: tableInfoWithColumns(2, "a"), Table: table}
+	require.NoError(t, worker.addEvent(ctx, key, row2))
+	f2 := recv()
+	require.Equal(t, BootstrapKindDelta, f2.Kind)
+	require.Empty(t, f2.Delta.Changes)
+	require.Equal(t, uint64(1), f2.Delta.BaseUpdateTS)
+
+	// case 3: forcing fullBootstrapInterval to have already elapsed re-emits
+	// Full even though there's still no schema change.
+	worker.SetFullBootstrapInterval(time.Nanosecond)
+	time.Sleep(10 * time.Millisecond)
+	row3 := &model.RowChangedEvent{TableInfo: tableInfoWithColumns(3, "a"), Table: table}
+	require.NoError(t, worker.addEvent(ctx, key, row3))
+	f3 := recv()
+	require.Equal(t, BootstrapKindFull, f3.Kind)
+}
+
+// TestBootstrapWorkerDeltaWithSchemaChange tests that a real column change
+// is reported in the Delta's Changes.
+func TestBootstrapWorkerDeltaWithSchemaChange(t *testing.T) {
+	t.Parallel()
+	builder := mockDeltaEncoderBuilder{}
+	outCh := make(chan *future, defaultInputChanSize)
+	worker := newBootstrapWorker(outCh, builder, time.Millisecond, defaultSendBootstrapInMsgCount, defaultMaxInactiveDuration)
+	worker.SetFullBootstrapInterval(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = worker.run(ctx) }()
+
+	key := TopicPartitionKey{Topic: "delta.t2", Partition: 0, TotalPartition: 1}
+	table := &model.TableName{Schema: "test", Table: "t2", TableID: 2}
+
+	row1 := &model.RowChangedEvent{TableInfo: tableInfoWithColumns(1, "a"), Table: table}
+	require.NoError(t, worker.addEvent(ctx, key, row1))
+	<-outCh // Full
+
+	time.Sleep(10 * time.Millisecond)
+	row2 := &model.RowChangedEvent{TableInfo: tableInfoWithColumns(2, "a", "b"), Table: table}
+	require.NoError(t, worker.addEvent(ctx, key, row2))
+	f2 := <-outCh
+	require.Equal(t, BootstrapKindDelta, f2.Kind)
+	require.Equal(t, []columnChange{{Kind: "add", Column: "b"}}, f2.Delta.Changes)
+}
+
+// TestBootstrapWorkerNotifyUnknownBaseVersion tests that a reported unknown
+// base version still held in history is re-synced with a Delta diffed
+// against that retained version, while a version evicted from history
+// falls back to a Full bootstrap.
+func TestBootstrapWorkerNotifyUnknownBaseVersion(t *testing.T) {
+	t.Parallel()
+	builder := mockDeltaEncoderBuilder{}
+	outCh := make(chan *future, defaultInputChanSize)
+	worker := newBootstrapWorker(outCh, builder, time.Millisecond, defaultSendBootstrapInMsgCount, defaultMaxInactiveDuration)
+	worker.SetFullBootstrapInterval(time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = worker.run(ctx) }()
+
+	key := TopicPartitionKey{Topic: "delta.t3", Partition: 0, TotalPartition: 1}
+	table := &model.TableName{Schema: "test", Table: "t3", TableID: 3}
+
+	send := func(updateTS uint64, cols ...string) *future {
+		row := &model.RowChangedEvent{TableInfo: tableInfoWithColumns(updateTS, cols...), Table: table}
+		require.NoError(t, worker.addEvent(ctx, key, row))
+		select {
+		case f := <-outCh:
+			return f
+		case <-time.After(3 * time.Second):
+			t.Fatal("timed out waiting for a bootstrap message")
+			return nil
+		}
+	}
+
+	f1 := send(1, "a")
+	require.Equal(t, BootstrapKindFull, f1.Kind)
+	time.Sleep(10 * time.Millisecond)
+
+	f2 := send(2, "a", "b")
+	require.Equal(t, BootstrapKindDelta, f2.Kind)
+	time.Sleep(10 * time.Millisecond)
+
+	f3 := send(3, "a", "b", "c")
+	require.Equal(t, BootstrapKindDelta, f3.Kind)
+	time.Sleep(10 * time.Millisecond)
+
+	// version 1 is still retained (tableInfoHistorySize == 3), so the next
+	// Delta re-syncs against it directly instead of falling back to Full.
+	worker.NotifyUnknownBaseVersion(key.Topic, table.TableID, 1)
+	f4 := send(4, "a", "b", "c", "d")
+	require.Equal(t, BootstrapKindDelta, f4.Kind)
+	require.Equal(t, uint64(1), f4.Delta.BaseUpdateTS)
+	require.Equal(t, []columnChange{
+		{Kind: "add", Column: "b"}, {Kind: "add", Column: "c"}, {Kind: "add", Column: "d"},
+	}, f4.Delta.Changes)
+	time.Sleep(10 * time.Millisecond)
+
+	// version 1 has since been evicted from history, so reporting it again
+	// forces a Full bootstrap instead of a Delta with a dangling base.
+	worker.NotifyUnknownBaseVersion(key.Topic, table.TableID, 1)
+	f5 := send(5, "a", "b", "c", "d")
+	require.Equal(t, BootstrapKindFull, f5.Kind)
+}